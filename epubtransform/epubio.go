@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pgaskin/epubtool/util"
 )
@@ -67,10 +68,81 @@ func replaceOutputWrapper(outputPath string, fn func(path string) OutputFunc) Ou
 
 // FileInput returns an InputFunc to read from an epub file.
 func FileInput(file string) InputFunc {
+	return func(epubdir string) error {
+		f, err := os.Open(file)
+		if err != nil {
+			return util.Wrap(err, "error opening input file")
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return util.Wrap(err, "error stating input file")
+		}
+
+		return ReaderInput(f, fi.Size())(epubdir)
+	}
+}
+
+// ReaderInput returns an InputFunc to read an epub from r, which must support
+// random access over size bytes (as required to parse it as a zip archive).
+// This allows reading epubs from sources other than the filesystem, such as
+// an in-memory buffer or an HTTP request body buffered to a temp file.
+func ReaderInput(r io.ReaderAt, size int64) InputFunc {
 	return func(epubdir string) error {
 		os.RemoveAll(epubdir)
-		return util.Unzip(file, epubdir)
+
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return util.Wrap(err, "error opening epub as a zip")
+		}
+		return unzipReader(zr, epubdir)
+	}
+}
+
+// unzipReader extracts every entry in zr into dir, which is created if it
+// does not already exist.
+func unzipReader(zr *zip.Reader, dir string) error {
+	for _, f := range zr.File {
+		if err := unzipReaderFile(f, dir); err != nil {
+			return util.Wrap(err, "error extracting %#v", f.Name)
+		}
+	}
+	return nil
+}
+
+func unzipReaderFile(f *zip.File, dir string) error {
+	// f.Name comes straight from the zip's central directory, so a crafted
+	// epub could use an absolute path or a "../" entry to write outside dir
+	// (zip-slip). Reject it the same way validateSafePath does for manifest
+	// hrefs, before it's ever joined onto dir.
+	if err := validateSafePath(f.Name); err != nil {
+		return fmt.Errorf("unsafe path %#v: %v", f.Name, err)
 	}
+	path := filepath.Join(dir, filepath.FromSlash(f.Name))
+
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(path, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	df, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	_, err = io.Copy(df, rc)
+	return err
 }
 
 // DirOutput returns an OutputFunc to write to a directory. The destination must not exist.
@@ -93,6 +165,19 @@ func DirInput(dir string) InputFunc {
 
 // FileOutput returns an OutputFunc write to a epub file. The destination must not exist.
 func FileOutput(file string) OutputFunc {
+	return FileOutputWithOptions(file, FileOutputOptions{})
+}
+
+// WriterOutput returns an OutputFunc which zips the epub directly to w
+// instead of a path on disk, allowing epubs to be streamed to things like an
+// HTTP response or stdout without an intermediate file.
+func WriterOutput(w io.Writer) OutputFunc {
+	return WriterOutputWithOptions(w, FileOutputOptions{})
+}
+
+// FileOutputWithOptions is like FileOutput, but with control over how the
+// zip is compressed. The destination must not exist.
+func FileOutputWithOptions(file string, opts FileOutputOptions) OutputFunc {
 	return func(epubdir string) error {
 		f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
@@ -100,53 +185,15 @@ func FileOutput(file string) OutputFunc {
 		}
 		defer f.Close()
 
-		zw := zip.NewWriter(f)
-		defer zw.Close()
-
-		if mimetypeWriter, err := zw.CreateHeader(&zip.FileHeader{
-			Name:   "mimetype",
-			Method: zip.Store, // Do not compress mimetype
-		}); err != nil {
-			return util.Wrap(err, "error writing mimetype to epub")
-		} else if _, err = mimetypeWriter.Write([]byte("application/epub+zip")); err != nil {
-			return util.Wrap(err, "error writing mimetype to epub")
-		}
-
-		if err := filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			relPath, err := filepath.Rel(epubdir, path)
-			if err != nil {
-				return fmt.Errorf("error getting relative path of %#v", path)
-			}
-
-			// Skip if it is trying to pack itself, is not regular file, or is mimetype
-			if path == epubdir || !info.Mode().IsRegular() || filepath.Base(path) == "mimetype" {
-				return nil
-			}
-
-			fw, err := zw.Create(relPath)
-			if err != nil {
-				return util.Wrap(err, `error creating file %#v in epub`, relPath)
-			}
-
-			sf, err := os.Open(path)
-			if err != nil {
-				return util.Wrap(err, "error reading file %#v", path)
-			}
-			defer sf.Close()
-
-			if _, err := io.Copy(fw, sf); err != nil {
-				return util.Wrap(err, "error writing file %#v to epub", relPath)
-			}
-
-			return nil
-		}); err != nil {
-			return util.Wrap(err, "error creating epub")
-		}
-
-		return nil
+		return WriterOutputWithOptions(f, opts)(epubdir)
 	}
 }
+
+// DeterministicFileOutput is like FileOutput, but packs entries in sorted
+// order with their modification times replaced by epoch so that identical
+// epubdir trees always produce byte-identical epubs. An epoch of time.Time{}
+// uses the earliest time the zip format can represent (1980-01-01). This
+// lets downstream tooling diff, sign, or cache epubs produced in CI.
+func DeterministicFileOutput(file string, epoch time.Time) OutputFunc {
+	return FileOutputWithOptions(file, FileOutputOptions{Deterministic: true, Epoch: epoch})
+}
@@ -0,0 +1,257 @@
+package epubtransform
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pgaskin/epubtool/util"
+)
+
+// FileOutputOptions controls how FileOutputWithOptions and
+// WriterOutputWithOptions compress and order epub contents.
+type FileOutputOptions struct {
+	// Workers is the number of files to compress concurrently. If <= 0,
+	// runtime.NumCPU() is used.
+	Workers int
+
+	// Level is the flate compression level passed to flate.NewWriter. The
+	// zero value selects flate.DefaultCompression rather than
+	// flate.NoCompression (which is also 0), so there is no way to request
+	// uncompressed entries through this field; pass a Level in [1,9] or
+	// flate.HuffmanOnly for anything other than the default.
+	Level int
+
+	// Deterministic, if true, packs entries in sorted archive-relative path
+	// order and replaces their modification times with Epoch, instead of
+	// using filepath.Walk's per-directory order and the files' own mtimes, so
+	// that identical input directories produce byte-identical zips.
+	Deterministic bool
+
+	// Epoch is the modification time stamped on every entry when
+	// Deterministic is set. The zero value uses the earliest time the zip
+	// format can represent (1980-01-01, the DOS epoch).
+	Epoch time.Time
+}
+
+// dosEpoch is the earliest date/time representable in a zip file header.
+var dosEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// normalized returns opts with zero-valued fields replaced by their defaults.
+func (opts FileOutputOptions) normalized() FileOutputOptions {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.Level == 0 {
+		opts.Level = flate.DefaultCompression
+	}
+	if opts.Deterministic && opts.Epoch.IsZero() {
+		opts.Epoch = dosEpoch
+	}
+	return opts
+}
+
+// WriterOutputWithOptions is like WriterOutput, but with control over how the
+// zip is compressed.
+func WriterOutputWithOptions(w io.Writer, opts FileOutputOptions) OutputFunc {
+	opts = opts.normalized()
+	return func(epubdir string) error {
+		entries, err := collectEntries(epubdir, opts.Deterministic)
+		if err != nil {
+			return util.Wrap(err, "error walking epub directory")
+		}
+
+		compressed, err := compressEntries(entries, opts)
+		if err != nil {
+			return util.Wrap(err, "error compressing epub contents")
+		}
+
+		zw := zip.NewWriter(w)
+
+		if err := writeMimetypeEntry(zw); err != nil {
+			return err
+		}
+
+		for i, e := range entries {
+			if err := writeRawEntry(zw, e, compressed[i], opts); err != nil {
+				return err
+			}
+		}
+
+		return zw.Close()
+	}
+}
+
+// walkedEntry is a single regular file to be packed into the epub, found by
+// walking the epubdir.
+type walkedEntry struct {
+	relPath string
+	path    string
+	info    os.FileInfo
+}
+
+// collectEntries walks epubdir for the regular files to pack, excluding
+// mimetype (which is always written first and uncompressed). If sorted, the
+// entries are ordered by relPath instead of by filesystem walk order.
+func collectEntries(epubdir string, sorted bool) ([]walkedEntry, error) {
+	var entries []walkedEntry
+	if err := filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == epubdir || !info.Mode().IsRegular() || filepath.Base(path) == "mimetype" {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(epubdir, path)
+		if err != nil {
+			return util.Wrap(err, "error getting relative path of %#v", path)
+		}
+
+		entries = append(entries, walkedEntry{filepath.ToSlash(relPath), path, info})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if sorted {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].relPath < entries[j].relPath })
+	}
+	return entries, nil
+}
+
+// compressedEntry holds a file's compressed deflate stream, ready to be
+// written into a zip with CreateRaw.
+type compressedEntry struct {
+	method uint16
+	crc32  uint32
+	usize  uint64
+	data   []byte
+}
+
+// compressEntries compresses entries concurrently across opts.Workers
+// goroutines, returning results in the same order as entries.
+func compressEntries(entries []walkedEntry, opts FileOutputOptions) ([]*compressedEntry, error) {
+	compressed := make([]*compressedEntry, len(entries))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				ce, err := compressFile(entries[idx], opts.Level)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = util.Wrap(err, "error compressing %#v", entries[idx].relPath)
+					}
+					mu.Unlock()
+					continue
+				}
+				compressed[idx] = ce
+			}
+		}()
+	}
+
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return compressed, firstErr
+}
+
+// compressFile reads and deflate-compresses a single file.
+func compressFile(e walkedEntry, level int) (*compressedEntry, error) {
+	raw, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &compressedEntry{
+		method: zip.Deflate,
+		crc32:  crc32.ChecksumIEEE(raw),
+		usize:  uint64(len(raw)),
+		data:   buf.Bytes(),
+	}, nil
+}
+
+// mimetypeContents is the fixed, required content of the epub mimetype entry.
+var mimetypeContents = []byte("application/epub+zip")
+
+// writeMimetypeEntry writes the mandatory, first, stored mimetype entry.
+// It uses CreateRaw (stored data is its own "compressed" form) instead of
+// CreateHeader, because CreateHeader always sets the data-descriptor flag and
+// appends a trailing descriptor for file entries, which readers that parse
+// the mimetype entry directly at offset 0 (e.g. Calibre) do not expect.
+func writeMimetypeEntry(zw *zip.Writer) error {
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store, // Do not compress mimetype
+		CRC32:              crc32.ChecksumIEEE(mimetypeContents),
+		UncompressedSize64: uint64(len(mimetypeContents)),
+		CompressedSize64:   uint64(len(mimetypeContents)),
+	})
+	if err != nil {
+		return util.Wrap(err, "error writing mimetype to epub")
+	}
+	if _, err := w.Write(mimetypeContents); err != nil {
+		return util.Wrap(err, "error writing mimetype to epub")
+	}
+	return nil
+}
+
+// writeRawEntry writes a precompressed entry to zw using CreateRaw, avoiding
+// re-compressing data compressEntries already produced.
+func writeRawEntry(zw *zip.Writer, e walkedEntry, ce *compressedEntry, opts FileOutputOptions) error {
+	fh := &zip.FileHeader{
+		Name:               e.relPath,
+		Method:             ce.method,
+		CRC32:              ce.crc32,
+		UncompressedSize64: ce.usize,
+		CompressedSize64:   uint64(len(ce.data)),
+	}
+	// CreateRaw writes the MS-DOS time fields as-is and ignores Modified, so
+	// SetModTime is used to fill them in.
+	if opts.Deterministic {
+		fh.SetModTime(opts.Epoch)
+	} else {
+		fh.SetModTime(e.info.ModTime())
+	}
+
+	w, err := zw.CreateRaw(fh)
+	if err != nil {
+		return util.Wrap(err, "error creating file %#v in epub", e.relPath)
+	}
+	if _, err := w.Write(ce.data); err != nil {
+		return util.Wrap(err, "error writing file %#v to epub", e.relPath)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package epubtransform
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+// TestWriteMimetypeEntryNoDataDescriptor ensures the mimetype entry never
+// carries the data-descriptor flag, since readers that parse it directly at
+// offset 0 (e.g. Calibre) don't expect one.
+func TestWriteMimetypeEntryNoDataDescriptor(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	if err := writeMimetypeEntry(zw); err != nil {
+		t.Fatalf("writeMimetypeEntry: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zw.Close: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	if len(zr.File) == 0 {
+		t.Fatal("expected at least one file in the archive")
+	}
+
+	f := zr.File[0]
+	if f.Name != "mimetype" {
+		t.Fatalf("expected first entry to be %#v, got %#v", "mimetype", f.Name)
+	}
+	if f.Flags&0x8 != 0 {
+		t.Errorf("mimetype entry has the data-descriptor flag set (Flags=%#x), want it clear", f.Flags)
+	}
+	if f.Method != zip.Store {
+		t.Errorf("mimetype entry method = %v, want zip.Store", f.Method)
+	}
+}
@@ -0,0 +1,139 @@
+package epubtransform
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pgaskin/epubtool/util"
+)
+
+// StreamTransform applies transforms to the epub read from in (of size
+// bytes) and writes the result to out.
+//
+// It does NOT avoid full extraction: transforms in this package are defined
+// as func(epubdir string) error and operate on an ordinary directory, so
+// every entry is still extracted to a temp directory up front, the same as
+// the FileInput/FileOutput round trip. What it avoids is recompression on
+// the way back out — after the transforms run, any file whose content
+// didn't change is repacked by copying its original raw deflate stream
+// (detected via a CRC32/size comparison against the input zip) instead of
+// being deflated again. For image-heavy epubs, where most resources pass
+// through unmodified, that recompression is the expensive part, so this
+// still gives a real win, just not one that comes from skipping extraction.
+func StreamTransform(in io.ReaderAt, size int64, out io.Writer, transforms ...Transform) error {
+	zr, err := zip.NewReader(in, size)
+	if err != nil {
+		return util.Wrap(err, "error opening epub as a zip")
+	}
+
+	td, err := ioutil.TempDir("", "epubio-stream-*")
+	if err != nil {
+		return util.Wrap(err, "error creating temp directory")
+	}
+	defer os.RemoveAll(td)
+
+	if err := unzipReader(zr, td); err != nil {
+		return util.Wrap(err, "error extracting epub")
+	}
+
+	for _, t := range transforms {
+		if err := t(td); err != nil {
+			return util.Wrap(err, "error applying transform")
+		}
+	}
+
+	return streamRepack(zr, td, out)
+}
+
+// streamRepack walks epubdir and writes out, reusing each entry's original
+// raw (still-compressed) bytes from zr whenever its content is unchanged,
+// and compressing only the entries a transform actually modified or added.
+func streamRepack(zr *zip.Reader, epubdir string, out io.Writer) error {
+	orig := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		orig[f.Name] = f
+	}
+
+	entries, err := collectEntries(epubdir, false)
+	if err != nil {
+		return util.Wrap(err, "error walking epub directory")
+	}
+
+	zw := zip.NewWriter(out)
+
+	if err := writeMimetypeEntry(zw); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		of, ok := orig[e.relPath]
+		if ok {
+			same, err := entryUnchanged(of, e.path)
+			if err != nil {
+				return util.Wrap(err, "error reading %#v", e.path)
+			}
+			if same {
+				if err := copyRawEntry(zw, of); err != nil {
+					return util.Wrap(err, "error copying unchanged entry %#v", e.relPath)
+				}
+				continue
+			}
+		}
+
+		ce, err := compressFile(e, flate.DefaultCompression)
+		if err != nil {
+			return util.Wrap(err, "error compressing %#v", e.relPath)
+		}
+		if err := writeRawEntry(zw, e, ce, FileOutputOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// entryUnchanged reports whether the file at path has the same content as
+// the original zip entry of, without decompressing of's data.
+func entryUnchanged(of *zip.File, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return false, err
+	}
+
+	return uint64(n) == of.UncompressedSize64 && h.Sum32() == of.CRC32, nil
+}
+
+// copyRawEntry copies of's compressed bytes directly into zw without
+// decompressing or recompressing them.
+func copyRawEntry(zw *zip.Writer, of *zip.File) error {
+	rc, err := of.OpenRaw()
+	if err != nil {
+		return err
+	}
+
+	// of.OpenRaw only ever returns exactly CompressedSize64 bytes, with no
+	// trailing data descriptor, regardless of whether the original archive
+	// used one. Clear bit 3 so streaming zip readers don't expect a
+	// descriptor we're not writing.
+	fh := of.FileHeader
+	fh.Flags &^= 0x8
+
+	w, err := zw.CreateRaw(&fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, rc)
+	return err
+}
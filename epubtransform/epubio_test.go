@@ -0,0 +1,42 @@
+package epubtransform
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReaderInputRejectsZipSlip ensures a crafted epub can't write outside
+// the destination directory via a ".." path entry.
+func TestReaderInputRejectsZipSlip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("../../tmp/epubtool-zipslip-poc")
+	if err != nil {
+		t.Fatalf("zw.Create: %v", err)
+	}
+	if _, err := fw.Write([]byte("pwned")); err != nil {
+		t.Fatalf("fw.Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zw.Close: %v", err)
+	}
+
+	epubdir, err := ioutil.TempDir("", "epubio-zipslip-*")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(epubdir)
+
+	err = ReaderInput(bytes.NewReader(buf.Bytes()), int64(buf.Len()))(epubdir)
+	if err == nil {
+		t.Fatal("expected ReaderInput to reject a zip-slip entry, got nil error")
+	}
+
+	if _, statErr := os.Stat(filepath.Join(epubdir, "..", "..", "tmp", "epubtool-zipslip-poc")); statErr == nil {
+		t.Fatal("zip-slip entry was written outside epubdir")
+	}
+}
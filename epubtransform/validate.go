@@ -0,0 +1,224 @@
+package epubtransform
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pgaskin/epubtool/util"
+)
+
+// ValidateOutput wraps next to run Validate against epubdir before it is
+// packaged, so a tree which would produce an epub rejected by readers like
+// Calibre (e.g. with "No META-INF/container.xml in epub") is caught with a
+// useful error instead of silently writing a broken file.
+func ValidateOutput(next OutputFunc) OutputFunc {
+	return func(epubdir string) error {
+		if err := Validate(epubdir); err != nil {
+			return util.Wrap(err, "epub failed packaging validation")
+		}
+		return next(epubdir)
+	}
+}
+
+// Validate checks epubdir against the OCF packaging rules required for a
+// conformant epub: a mimetype file containing exactly "application/epub+zip",
+// a META-INF/container.xml resolving to at least one existing OPF rootfile,
+// an OPF manifest whose items all exist on disk with a plausible media-type,
+// and no absolute/".." paths or stray OS junk files. It does not check the
+// OPF content model beyond the manifest. Validate only sees epubdir as a
+// plain directory tree, so it cannot check zip-level framing of the
+// mimetype entry (that it ends up first, stored, and without a data
+// descriptor) — that's guaranteed separately by writeMimetypeEntry, which
+// every zip-writing output in this package uses to pack it.
+func Validate(epubdir string) error {
+	if err := validateMimetype(epubdir); err != nil {
+		return err
+	}
+
+	rootfiles, err := validateContainer(epubdir)
+	if err != nil {
+		return err
+	}
+
+	for _, rf := range rootfiles {
+		if err := validateManifest(epubdir, rf); err != nil {
+			return err
+		}
+	}
+
+	return validateNoJunk(epubdir)
+}
+
+// validateMimetype only checks the extracted mimetype file's content; it
+// cannot see whether the packed zip entry will be first, stored, and free of
+// a data descriptor, since epubdir is a plain directory by this point.
+func validateMimetype(epubdir string) error {
+	buf, err := ioutil.ReadFile(filepath.Join(epubdir, "mimetype"))
+	if err != nil {
+		return util.Wrap(err, "missing mimetype file")
+	}
+	if string(buf) != "application/epub+zip" {
+		return fmt.Errorf("mimetype file must contain exactly %q, got %q", "application/epub+zip", string(buf))
+	}
+	return nil
+}
+
+type ocfContainer struct {
+	XMLName   xml.Name `xml:"container"`
+	Rootfiles struct {
+		Rootfile []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfile"`
+	} `xml:"rootfiles"`
+}
+
+// validateContainer parses META-INF/container.xml and returns the
+// epubdir-relative paths of its rootfiles.
+func validateContainer(epubdir string) ([]string, error) {
+	cpath := filepath.Join(epubdir, "META-INF", "container.xml")
+	buf, err := ioutil.ReadFile(cpath)
+	if err != nil {
+		return nil, util.Wrap(err, "missing META-INF/container.xml")
+	}
+
+	var c ocfContainer
+	if err := xml.Unmarshal(buf, &c); err != nil {
+		return nil, util.Wrap(err, "could not parse META-INF/container.xml")
+	}
+
+	var rootfiles []string
+	for _, rf := range c.Rootfiles.Rootfile {
+		if rf.MediaType != "application/oebps-package+xml" {
+			continue
+		}
+		if filepath.Ext(rf.FullPath) != ".opf" {
+			continue
+		}
+		if err := validateSafePath(rf.FullPath); err != nil {
+			return nil, fmt.Errorf("container.xml rootfile %#v: %v", rf.FullPath, err)
+		}
+		if _, err := os.Stat(filepath.Join(epubdir, filepath.FromSlash(rf.FullPath))); err != nil {
+			return nil, fmt.Errorf("container.xml rootfile %#v does not exist", rf.FullPath)
+		}
+		rootfiles = append(rootfiles, rf.FullPath)
+	}
+
+	if len(rootfiles) == 0 {
+		return nil, errors.New("container.xml does not resolve to any *.opf rootfile")
+	}
+	return rootfiles, nil
+}
+
+type opfPackage struct {
+	XMLName  xml.Name `xml:"package"`
+	Manifest struct {
+		Item []struct {
+			Href      string `xml:"href,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"item"`
+	} `xml:"manifest"`
+}
+
+// validateManifest checks that every manifest item in the OPF at
+// epubdir/rootfile exists on disk with a media-type consistent with its
+// extension.
+func validateManifest(epubdir, rootfile string) error {
+	opfPath := filepath.Join(epubdir, filepath.FromSlash(rootfile))
+	buf, err := ioutil.ReadFile(opfPath)
+	if err != nil {
+		return util.Wrap(err, "could not read %#v", rootfile)
+	}
+
+	var pkg opfPackage
+	if err := xml.Unmarshal(buf, &pkg); err != nil {
+		return util.Wrap(err, "could not parse %#v", rootfile)
+	}
+
+	opfDir := filepath.Dir(opfPath)
+	for _, item := range pkg.Manifest.Item {
+		if item.Href == "" {
+			return fmt.Errorf("manifest item in %#v is missing an href", rootfile)
+		}
+		if err := validateSafePath(item.Href); err != nil {
+			return fmt.Errorf("manifest item %#v in %#v: %v", item.Href, rootfile, err)
+		}
+
+		ipath := filepath.Join(opfDir, filepath.FromSlash(item.Href))
+		if _, err := os.Stat(ipath); err != nil {
+			return fmt.Errorf("manifest item %#v in %#v does not exist", item.Href, rootfile)
+		}
+
+		if want := mediaTypeByExt(filepath.Ext(item.Href)); want != "" && want != item.MediaType {
+			return fmt.Errorf("manifest item %#v declares media-type %#v, expected %#v", item.Href, item.MediaType, want)
+		}
+	}
+	return nil
+}
+
+// mediaTypeByExt returns the expected media-type for common epub resource
+// extensions, or "" if the extension isn't one we check.
+func mediaTypeByExt(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".xhtml", ".html", ".htm":
+		return "application/xhtml+xml"
+	case ".ncx":
+		return "application/x-dtbncx+xml"
+	case ".css":
+		return "text/css"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".svg":
+		return "image/svg+xml"
+	default:
+		return ""
+	}
+}
+
+// validateSafePath rejects manifest hrefs which would escape the epub
+// directory if resolved relative to the OPF, or which reference an absolute
+// path.
+func validateSafePath(p string) error {
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "/") {
+		return errors.New("absolute paths are not allowed")
+	}
+	for _, part := range strings.Split(filepath.ToSlash(p), "/") {
+		if part == ".." {
+			return errors.New("\"..\" path segments are not allowed")
+		}
+	}
+	return nil
+}
+
+// junkFiles lists filenames commonly left behind by OSes and editors which
+// should never be packed into an epub.
+var junkFiles = map[string]bool{
+	".DS_Store":   true,
+	"Thumbs.db":   true,
+	"desktop.ini": true,
+}
+
+func validateNoJunk(epubdir string) error {
+	return filepath.Walk(epubdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == epubdir {
+			return nil
+		}
+		if junkFiles[filepath.Base(path)] {
+			rel, _ := filepath.Rel(epubdir, path)
+			return fmt.Errorf("stray OS junk file %#v should not be packed into the epub", rel)
+		}
+		return nil
+	})
+}
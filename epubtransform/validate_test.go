@@ -0,0 +1,137 @@
+package epubtransform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const validContainerXML = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`
+
+const validOPF = `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="c1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+	</manifest>
+</package>`
+
+// writeFile writes data to a path under root, creating parent directories as needed.
+func writeFile(t *testing.T, root, rel, data string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// validEpubdir builds a minimal, valid epub directory tree for use as a
+// baseline in the negative-case tests below.
+func validEpubdir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "epubtool-validate-*")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	writeFile(t, dir, "mimetype", "application/epub+zip")
+	writeFile(t, dir, "META-INF/container.xml", validContainerXML)
+	writeFile(t, dir, "OEBPS/content.opf", validOPF)
+	writeFile(t, dir, "OEBPS/chapter1.xhtml", "<html/>")
+	return dir
+}
+
+func TestValidateValid(t *testing.T) {
+	if err := Validate(validEpubdir(t)); err != nil {
+		t.Fatalf("expected a valid epubdir to pass validation, got: %v", err)
+	}
+}
+
+func TestValidateMissingContainerXML(t *testing.T) {
+	dir := validEpubdir(t)
+	if err := os.Remove(filepath.Join(dir, "META-INF", "container.xml")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error for a missing container.xml")
+	}
+}
+
+func TestValidateContainerRootfileEscapesDir(t *testing.T) {
+	dir := validEpubdir(t)
+	writeFile(t, dir, "META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="../../../../somewhere/evil.opf" media-type="application/oebps-package+xml"/>
+	</rootfiles>
+</container>`)
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error for a container.xml rootfile full-path containing \"..\"")
+	}
+}
+
+func TestValidateNoMatchingRootfile(t *testing.T) {
+	dir := validEpubdir(t)
+	writeFile(t, dir, "META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+	<rootfiles>
+		<rootfile full-path="OEBPS/content.opf" media-type="text/plain"/>
+	</rootfiles>
+</container>`)
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error when container.xml has no matching *.opf rootfile")
+	}
+}
+
+func TestValidateAbsoluteManifestHref(t *testing.T) {
+	dir := validEpubdir(t)
+	writeFile(t, dir, "OEBPS/content.opf", `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="c1" href="/etc/passwd" media-type="application/xhtml+xml"/>
+	</manifest>
+</package>`)
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error for an absolute manifest href")
+	}
+}
+
+func TestValidateManifestHrefEscapesDir(t *testing.T) {
+	dir := validEpubdir(t)
+	writeFile(t, dir, "OEBPS/content.opf", `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+	<manifest>
+		<item id="c1" href="../../../../etc/passwd" media-type="application/xhtml+xml"/>
+	</manifest>
+</package>`)
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error for a manifest href containing \"..\"")
+	}
+}
+
+func TestValidateMissingManifestItem(t *testing.T) {
+	dir := validEpubdir(t)
+	if err := os.Remove(filepath.Join(dir, "OEBPS", "chapter1.xhtml")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error when a manifest item doesn't exist on disk")
+	}
+}
+
+func TestValidateJunkFile(t *testing.T) {
+	dir := validEpubdir(t)
+	writeFile(t, dir, "OEBPS/.DS_Store", "junk")
+	if err := Validate(dir); err == nil {
+		t.Fatal("expected an error for a stray .DS_Store file")
+	}
+}